@@ -18,13 +18,16 @@ package gatherers
 
 import (
 	"fmt"
+	"net/http"
 	"sort"
 	"strconv"
 	"sync"
 	"time"
 
+	"github.com/prometheus/client_golang/prometheus"
 	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
 	clientset "k8s.io/client-go/kubernetes"
 	"k8s.io/klog"
 	"k8s.io/kubernetes/pkg/util/system"
@@ -55,13 +58,27 @@ func (r *ResourceUsageSummary) Get(perc string) []util.SingleContainerSummary {
 
 // ContainerResourceGatherer gathers resource metrics from containers.
 type ContainerResourceGatherer struct {
-	client       clientset.Interface
-	isRunning    bool
-	stopCh       chan struct{}
-	workers      []resourceGatherWorker
-	workerWg     sync.WaitGroup
-	containerIDs []string
-	options      ResourceGathererOptions
+	client          clientset.Interface
+	isRunning       bool
+	stopCh          chan struct{}
+	workersLock     sync.Mutex
+	workers         []*resourceGatherWorker
+	departedWorkers []*resourceGatherWorker
+	workerWg        sync.WaitGroup
+	// removalWg tracks the background goroutines removeWorkerForNode spawns
+	// to wait for a departed node's worker to actually finish before folding
+	// it into departedWorkers; StopAndSummarize waits on it so it never reads
+	// departedWorkers while one of those goroutines is still mid-append.
+	removalWg       sync.WaitGroup
+	containerIDs    []string
+	options         ResourceGathererOptions
+	informerFactory informers.SharedInformerFactory
+	startedCh       chan struct{}
+	metricsServer   *http.Server
+	metricsReg      *prometheus.Registry
+	cpuGauge        *prometheus.GaugeVec
+	memGauge        *prometheus.GaugeVec
+	quantileGauge   *prometheus.GaugeVec
 }
 
 // ResourceGathererOptions specifies options for ContainerResourceGatherer.
@@ -71,6 +88,32 @@ type ResourceGathererOptions struct {
 	ResourceDataGatheringPeriod time.Duration
 	ProbeDuration               time.Duration
 	PrintVerboseLogs            bool
+	// UseInformers switches pod/node discovery from a one-shot List snapshot
+	// to shared informers, so that workers are spawned/stopped as pods and
+	// nodes come and go over the lifetime of the gatherer.
+	UseInformers bool
+	// PrometheusListenAddr, when non-empty, makes StartGatheringData serve
+	// live container resource samples on this address at /metrics, so a run
+	// in progress can be scraped instead of only read back at the end.
+	PrometheusListenAddr string
+	// BundleProgress, if set, receives a BundleProgress update from
+	// WriteSupportBundle after each node's CSV files are added to the archive
+	// and once more after manifest.json, so callers can render a progress bar.
+	// Optional; each update is a blocking send, so callers must drain the
+	// channel from another goroutine.
+	BundleProgress chan<- BundleProgress
+	// StreamingQuantile computes the summary percentiles from per-container
+	// t-digest sketches, giving approximate quantiles. Workers still retain
+	// every raw sample for the whole run; the sketches are built from those
+	// samples when the summary is computed, so this option does not reduce the
+	// memory the gatherer holds. Short runs and tests should leave this false
+	// to keep the exact computation.
+	StreamingQuantile bool
+	// Metrics selects which resource dimensions to report beyond CPU and
+	// memory, pulled from the kubelet's /stats/summary response. CPU and
+	// memory are reported whichever kinds are listed. Defaults to CPU+memory,
+	// preserving the gatherer's original output shape.
+	Metrics []MetricKind
 }
 
 func isDaemonPod(pod *corev1.Pod) bool {
@@ -84,27 +127,40 @@ func isDaemonPod(pod *corev1.Pod) bool {
 
 // NewResourceUsageGatherer creates new instance of ContainerResourceGatherer
 func NewResourceUsageGatherer(c clientset.Interface, host, provider string, options ResourceGathererOptions, pods *corev1.PodList) (*ContainerResourceGatherer, error) {
+	if len(options.Metrics) == 0 {
+		options.Metrics = defaultMetrics
+	}
 	g := ContainerResourceGatherer{
 		client:       c,
 		isRunning:    true,
 		stopCh:       make(chan struct{}),
 		containerIDs: make([]string, 0),
 		options:      options,
+		startedCh:    make(chan struct{}),
 	}
 
 	if options.InKubemark {
 		g.workerWg.Add(1)
-		g.workers = append(g.workers, resourceGatherWorker{
+		g.workers = append(g.workers, &resourceGatherWorker{
 			inKubemark:                  true,
-			stopCh:                      g.stopCh,
+			stopCh:                      make(chan struct{}),
+			doneCh:                      make(chan struct{}),
 			wg:                          &g.workerWg,
-			finished:                    false,
+			dataSeries:                  newDataSeriesStore(),
+			metrics:                     options.Metrics,
 			resourceDataGatheringPeriod: options.ResourceDataGatheringPeriod,
 			probeDuration:               options.ProbeDuration,
 			printVerboseLogs:            options.PrintVerboseLogs,
 			host:                        host,
 			provider:                    provider,
 		})
+	} else if options.UseInformers {
+		// Discovery of pods/nodes is handed off to shared informers, which keep
+		// spawning/stopping workers for the lifetime of the gatherer instead of
+		// relying on a single List snapshot taken here.
+		if err := g.setupInformers(); err != nil {
+			return nil, fmt.Errorf("setting up informers error: %v", err)
+		}
 	} else {
 		// Tracks kube-system pods if no valid PodList is passed in.
 		var err error
@@ -143,13 +199,15 @@ func NewResourceUsageGatherer(c clientset.Interface, host, provider string, opti
 		for _, node := range nodeList.Items {
 			if options.Nodes == AllNodes || system.IsMasterNode(node.Name) || dnsNodes[node.Name] {
 				g.workerWg.Add(1)
-				g.workers = append(g.workers, resourceGatherWorker{
+				g.workers = append(g.workers, &resourceGatherWorker{
 					c:                           c,
 					nodeName:                    node.Name,
 					wg:                          &g.workerWg,
 					containerIDs:                g.containerIDs,
-					stopCh:                      g.stopCh,
-					finished:                    false,
+					stopCh:                      make(chan struct{}),
+					doneCh:                      make(chan struct{}),
+					dataSeries:                  newDataSeriesStore(),
+					metrics:                     options.Metrics,
 					inKubemark:                  false,
 					resourceDataGatheringPeriod: options.ResourceDataGatheringPeriod,
 					probeDuration:               options.ProbeDuration,
@@ -165,17 +223,40 @@ func NewResourceUsageGatherer(c clientset.Interface, host, provider string, opti
 }
 
 // StartGatheringData starts a stat gathering worker blocks for each node to track,
-// and blocks until StopAndSummarize is called.
+// and blocks until StopAndSummarize is called. When options.UseInformers is set,
+// additional worker blocks are started on the fly as the pod/node informers
+// discover new nodes to track.
 func (g *ContainerResourceGatherer) StartGatheringData() {
-	if len(g.workers) == 0 {
-		return
+	if g.options.PrometheusListenAddr != "" {
+		g.startMetricsServer()
+	}
+
+	g.workersLock.Lock()
+	close(g.startedCh)
+	n := len(g.workers)
+	delayPeriod := time.Duration(0)
+	if n > 0 {
+		delayPeriod = g.options.ResourceDataGatheringPeriod / time.Duration(n)
 	}
-	delayPeriod := g.options.ResourceDataGatheringPeriod / time.Duration(len(g.workers))
 	delay := time.Duration(0)
-	for i := range g.workers {
+	for i := 0; i < n; i++ {
 		go g.workers[i].gather(delay)
 		delay += delayPeriod
 	}
+	g.workersLock.Unlock()
+
+	if n == 0 && !g.options.UseInformers {
+		return
+	}
+
+	// Block on stopCh rather than workerWg directly: when UseInformers is set
+	// and no node matches options.Nodes yet, workerWg's counter is still zero
+	// here, and a later onNodeAdd/onPodAdd's Add(1) would race this call per
+	// sync.WaitGroup's documented contract ("calls with a positive delta that
+	// start when the counter is zero must happen before a Wait"). stopCh is
+	// only closed by stop() (via StopAndSummarize/Dispose), after which no
+	// more workers are added, so waiting on workerWg afterwards is race-free.
+	<-g.stopCh
 	g.workerWg.Wait()
 }
 
@@ -195,26 +276,45 @@ func (g *ContainerResourceGatherer) StopAndSummarize(percentiles []int) (*Resour
 	case <-time.After(2 * time.Minute):
 		unfinished := make([]string, 0)
 		for i := range g.workers {
-			if !g.workers[i].finished {
+			if !g.workers[i].isFinished() {
 				unfinished = append(unfinished, g.workers[i].nodeName)
 			}
 		}
 		klog.Infof("Timed out while waiting for waitgroup, some workers failed to finish: %v", unfinished)
 	}
 
+	// removeWorkerForNode moves a departed node's worker into departedWorkers
+	// from a background goroutine once it actually finishes; wait for any
+	// still in flight so allWorkers below doesn't race that append.
+	g.removalWg.Wait()
+
+	g.workersLock.Lock()
+	// Workers whose node disappeared mid-run were already stopped and set
+	// aside in departedWorkers by removeWorkerForNode; summarize folds their
+	// data series in alongside the still-tracked workers'.
+	allWorkers := append(append([]*resourceGatherWorker{}, g.workers...), g.departedWorkers...)
+	g.workersLock.Unlock()
+	return summarize(allWorkers, percentiles, g.options.StreamingQuantile, g.options.Metrics)
+}
+
+// summarize computes the percentile summary across the given workers' data
+// series. Shared by StopAndSummarize and WriteSupportBundle's manifest.
+func summarize(workers []*resourceGatherWorker, percentiles []int, streaming bool, metrics []MetricKind) (*ResourceUsageSummary, error) {
 	if len(percentiles) == 0 {
 		klog.Infof("Warning! Empty percentile list for stopAndPrintData.")
 		return &ResourceUsageSummary{}, fmt.Errorf("failed to get any resource usage data")
 	}
+	if streaming {
+		return summarizeStreaming(workers, percentiles)
+	}
 	data := make(map[int]util.ResourceUsagePerContainer)
-	for i := range g.workers {
-		if g.workers[i].finished {
-			stats := util.ComputePercentiles(g.workers[i].dataSeries, percentiles)
+	for i := range workers {
+		if workers[i].isFinished() {
+			stats := util.ComputePercentiles(workers[i].dataSeries.snapshot(), percentiles)
 			data = util.LeftMergeData(stats, data)
 		}
 	}
 
-	// Workers has been stopped. We need to gather data stored in them.
 	sortedKeys := []string{}
 	for name := range data[percentiles[0]] {
 		sortedKeys = append(sortedKeys, name)
@@ -224,17 +324,100 @@ func (g *ContainerResourceGatherer) StopAndSummarize(percentiles []int) (*Resour
 	for _, perc := range percentiles {
 		for _, name := range sortedKeys {
 			usage := data[perc][name]
-			summary[strconv.Itoa(perc)] = append(summary[strconv.Itoa(perc)], util.SingleContainerSummary{
+			single := util.SingleContainerSummary{
 				Name: name,
 				Cpu:  usage.CPUUsageInCores,
 				Mem:  usage.MemoryWorkingSetInBytes,
+			}
+			if hasMetric(metrics, MetricNetwork) {
+				single.RxBytesPerSecond = usage.RxBytesPerSecond
+				single.TxBytesPerSecond = usage.TxBytesPerSecond
+			}
+			if hasMetric(metrics, MetricFilesystem) {
+				single.FsUsedBytes = usage.FsUsedBytes
+				single.FsInodesUsed = usage.FsInodesUsed
+				single.LogsUsedBytes = usage.LogsUsedBytes
+			}
+			if hasMetric(metrics, MetricEphemeralStorage) {
+				single.EphemeralStorageUsedBytes = usage.EphemeralStorageUsedBytes
+			}
+			summary[strconv.Itoa(perc)] = append(summary[strconv.Itoa(perc)], single)
+		}
+	}
+	return &summary, nil
+}
+
+// summarizeStreaming is the StreamingQuantile counterpart of summarize: it
+// folds every worker's retained dataSeries samples into a per-container
+// t-digest, merging digests across workers (the
+// MasterAndDNSNodes-style aggregation case) before querying each requested
+// quantile. It only covers CPU and memory -- the other Metrics kinds still
+// require the exact (non-streaming) path.
+func summarizeStreaming(workers []*resourceGatherWorker, percentiles []int) (*ResourceUsageSummary, error) {
+	cpuDigests := make(map[string]*TDigest)
+	memDigests := make(map[string]*TDigest)
+	for i := range workers {
+		if !workers[i].isFinished() {
+			continue
+		}
+		workerCPU, workerMem := buildWorkerDigests(workers[i])
+		for name, d := range workerCPU {
+			if existing, ok := cpuDigests[name]; ok {
+				existing.Merge(d)
+			} else {
+				cpuDigests[name] = d
+			}
+		}
+		for name, d := range workerMem {
+			if existing, ok := memDigests[name]; ok {
+				existing.Merge(d)
+			} else {
+				memDigests[name] = d
+			}
+		}
+	}
+
+	sortedKeys := make([]string, 0, len(cpuDigests))
+	for name := range cpuDigests {
+		sortedKeys = append(sortedKeys, name)
+	}
+	sort.Strings(sortedKeys)
+
+	summary := make(ResourceUsageSummary)
+	for _, perc := range percentiles {
+		q := float64(perc) / 100
+		for _, name := range sortedKeys {
+			summary[strconv.Itoa(perc)] = append(summary[strconv.Itoa(perc)], util.SingleContainerSummary{
+				Name: name,
+				Cpu:  cpuDigests[name].Quantile(q),
+				Mem:  int64(memDigests[name].Quantile(q)),
 			})
 		}
 	}
 	return &summary, nil
 }
 
-// Dispose disposes container resource gatherer.
+// buildWorkerDigests feeds w's dataSeries samples into a per-container
+// CPU/memory t-digest each, preserving ResourceDataGatheringPeriod-spaced
+// samples' relative weight by inserting them with weight 1 in order.
+func buildWorkerDigests(w *resourceGatherWorker) (map[string]*TDigest, map[string]*TDigest) {
+	cpu := make(map[string]*TDigest)
+	mem := make(map[string]*TDigest)
+	for _, snapshot := range w.dataSeries.snapshot() {
+		for name, usage := range snapshot {
+			if cpu[name] == nil {
+				cpu[name] = NewTDigest(defaultTDigestCompression)
+				mem[name] = NewTDigest(defaultTDigestCompression)
+			}
+			cpu[name].Add(usage.CPUUsageInCores, 1)
+			mem[name].Add(float64(usage.MemoryWorkingSetInBytes), 1)
+		}
+	}
+	return cpu, mem
+}
+
+// Dispose disposes container resource gatherer, stopping all workers and,
+// when UseInformers is set, the pod/node informer factory backing them.
 func (g *ContainerResourceGatherer) Dispose() {
 	g.stop()
 }
@@ -242,6 +425,14 @@ func (g *ContainerResourceGatherer) Dispose() {
 func (g *ContainerResourceGatherer) stop() {
 	if g.isRunning {
 		g.isRunning = false
+		g.workersLock.Lock()
+		for i := range g.workers {
+			close(g.workers[i].stopCh)
+		}
+		g.workersLock.Unlock()
+		// Closing stopCh also stops the pod/node informers informerFactory.Start
+		// launched when UseInformers is set, and refreshMetricsLoop.
 		close(g.stopCh)
+		g.stopMetricsServer()
 	}
 }
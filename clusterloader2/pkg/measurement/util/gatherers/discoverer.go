@@ -0,0 +1,250 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gatherers
+
+import (
+	"fmt"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog"
+	"k8s.io/kubernetes/pkg/util/system"
+)
+
+// setupInformers wires up shared informers that discover Pods and Nodes
+// matching options.Nodes, analogous to the k8s_state collector's
+// discover_kubernetes/discover_node/discover_pod approach, and spawns or
+// stops resourceGatherWorkers as they come and go for the lifetime of the
+// gatherer instead of relying on a one-shot List snapshot.
+func (g *ContainerResourceGatherer) setupInformers() error {
+	g.informerFactory = informers.NewSharedInformerFactory(g.client, 0)
+	podInformer := g.informerFactory.Core().V1().Pods().Informer()
+	nodeInformer := g.informerFactory.Core().V1().Nodes().Informer()
+
+	podInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc: g.onPodAdd,
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			g.onPodUpdate(newObj)
+		},
+		DeleteFunc: g.onPodDelete,
+	})
+	nodeInformer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		AddFunc:    g.onNodeAdd,
+		DeleteFunc: g.onNodeDelete,
+	})
+
+	g.informerFactory.Start(g.stopCh)
+	if !cache.WaitForCacheSync(g.stopCh, podInformer.HasSynced, nodeInformer.HasSynced) {
+		return fmt.Errorf("timed out waiting for pod/node informer caches to sync")
+	}
+	return nil
+}
+
+func (g *ContainerResourceGatherer) onPodAdd(obj interface{}) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+	g.onPodUpsert(pod)
+}
+
+// onPodUpdate re-runs the same discovery onPodAdd does: a pod's
+// ContainerStatuses are normally still empty the moment the informer first
+// observes it (the kubelet hasn't reported yet), so the containers it
+// eventually runs are only known once a later Update fires.
+func (g *ContainerResourceGatherer) onPodUpdate(obj interface{}) {
+	pod, ok := obj.(*corev1.Pod)
+	if !ok {
+		return
+	}
+	g.onPodUpsert(pod)
+}
+
+func (g *ContainerResourceGatherer) onPodUpsert(pod *corev1.Pod) {
+	if pod.Namespace != "kube-system" {
+		return
+	}
+	isMaster := system.IsMasterNode(pod.Spec.NodeName)
+	isDNS := pod.Labels["k8s-app"] == "kube-dns"
+	switch g.options.Nodes {
+	case MasterNodes:
+		if !isMaster {
+			return
+		}
+	case MasterAndDNSNodes:
+		if !isMaster && !isDNS {
+			return
+		}
+	case MasterAndNonDaemons:
+		if !isMaster && isDaemonPod(pod) {
+			return
+		}
+	}
+
+	g.workersLock.Lock()
+	for _, container := range pod.Status.InitContainerStatuses {
+		g.containerIDs = append(g.containerIDs, container.Name)
+	}
+	for _, container := range pod.Status.ContainerStatuses {
+		g.containerIDs = append(g.containerIDs, container.Name)
+	}
+	containerIDs := append([]string(nil), g.containerIDs...)
+	g.workersLock.Unlock()
+
+	g.ensureWorkerForNode(pod.Spec.NodeName, containerIDs)
+}
+
+func (g *ContainerResourceGatherer) onPodDelete(obj interface{}) {
+	// Pod churn on a node we already track doesn't tear down that node's
+	// worker; a worker is only stopped once its node disappears, see
+	// onNodeDelete.
+}
+
+func (g *ContainerResourceGatherer) onNodeAdd(obj interface{}) {
+	node, ok := toNode(obj)
+	if !ok {
+		return
+	}
+	if g.options.Nodes != AllNodes && !system.IsMasterNode(node.Name) {
+		// Non-master nodes for MasterAndDNSNodes/MasterAndNonDaemons are only
+		// tracked once a qualifying pod lands on them, see onPodAdd.
+		return
+	}
+	g.workersLock.Lock()
+	containerIDs := append([]string(nil), g.containerIDs...)
+	g.workersLock.Unlock()
+	g.ensureWorkerForNode(node.Name, containerIDs)
+}
+
+func (g *ContainerResourceGatherer) onNodeDelete(obj interface{}) {
+	node, ok := toNode(obj)
+	if !ok {
+		return
+	}
+	g.removeWorkerForNode(node.Name)
+}
+
+func toNode(obj interface{}) (*corev1.Node, bool) {
+	node, ok := obj.(*corev1.Node)
+	if ok {
+		return node, true
+	}
+	tombstone, ok := obj.(cache.DeletedFinalStateUnknown)
+	if !ok {
+		return nil, false
+	}
+	node, ok = tombstone.Obj.(*corev1.Node)
+	return node, ok
+}
+
+// ensureWorkerForNode spawns a resourceGatherWorker for nodeName if one isn't
+// already tracked, staggering its start the same way StartGatheringData does
+// for the initial batch (ResourceDataGatheringPeriod / N). If a
+// worker for nodeName already exists, its containerIDs are refreshed instead
+// -- onPodUpdate calls in with a fuller list than onPodAdd had when the
+// worker was first created, since a pod's ContainerStatuses are normally
+// still empty at the moment it's first observed.
+func (g *ContainerResourceGatherer) ensureWorkerForNode(nodeName string, containerIDs []string) {
+	g.workersLock.Lock()
+	defer g.workersLock.Unlock()
+	for i := range g.workers {
+		if g.workers[i].nodeName == nodeName {
+			g.workers[i].setContainerIDs(containerIDs)
+			return
+		}
+	}
+
+	idx := len(g.workers)
+	g.workers = append(g.workers, &resourceGatherWorker{
+		c:                           g.client,
+		nodeName:                    nodeName,
+		wg:                          &g.workerWg,
+		containerIDs:                containerIDs,
+		stopCh:                      make(chan struct{}),
+		doneCh:                      make(chan struct{}),
+		dataSeries:                  newDataSeriesStore(),
+		metrics:                     g.options.Metrics,
+		inKubemark:                  false,
+		resourceDataGatheringPeriod: g.options.ResourceDataGatheringPeriod,
+		probeDuration:               g.options.ProbeDuration,
+		printVerboseLogs:            g.options.PrintVerboseLogs,
+	})
+	g.workerWg.Add(1)
+	delay := g.staggeredDelayLocked(idx + 1)
+
+	select {
+	case <-g.startedCh:
+		klog.Infof("Discovered node %q, starting a new resource gather worker (delay %v)", nodeName, delay)
+		go g.workers[idx].gather(delay)
+	default:
+		// StartGatheringData hasn't run yet; it will start this worker itself.
+	}
+}
+
+// removeWorkerForNode stops the worker tracking nodeName, if any, and -- once
+// it has actually finished -- moves it into departedWorkers so
+// StopAndSummarize/WriteSupportBundle still fold its dataSeries into the
+// aggregate once the run completes.
+//
+// g.workers holds *resourceGatherWorker, so compacting it in place (below)
+// only shifts pointers around; it never touches the worker structs
+// themselves, which is what every running gather goroutine holds a
+// reference to. The worker isn't appended to departedWorkers until
+// waitFinished returns, so a worker is never observed (and folded into a
+// summary) before its own goroutine has actually stopped appending to it.
+func (g *ContainerResourceGatherer) removeWorkerForNode(nodeName string) {
+	g.workersLock.Lock()
+	var removed *resourceGatherWorker
+	for i, w := range g.workers {
+		if w.nodeName != nodeName {
+			continue
+		}
+		removed = w
+		g.workers = append(g.workers[:i], g.workers[i+1:]...)
+		break
+	}
+	g.workersLock.Unlock()
+
+	if removed == nil {
+		return
+	}
+	klog.Infof("Node %q removed, stopping its resource gather worker", nodeName)
+	close(removed.stopCh)
+
+	g.removalWg.Add(1)
+	go func() {
+		defer g.removalWg.Done()
+		removed.waitFinished()
+		g.workersLock.Lock()
+		g.departedWorkers = append(g.departedWorkers, removed)
+		g.workersLock.Unlock()
+	}()
+}
+
+// staggeredDelayLocked spreads worker start times across
+// ResourceDataGatheringPeriod, the same jitter StartGatheringData applies
+// to the initial batch of workers. Must be called with workersLock
+// held.
+func (g *ContainerResourceGatherer) staggeredDelayLocked(n int) time.Duration {
+	if n <= 0 {
+		return 0
+	}
+	period := g.options.ResourceDataGatheringPeriod / time.Duration(n)
+	return period * time.Duration((n-1)%n)
+}
@@ -0,0 +1,47 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gatherers
+
+// MetricKind selects one of the resource dimensions the kubelet's
+// /stats/summary response exposes per container/pod.
+type MetricKind string
+
+const (
+	// MetricCPU tracks CPUUsageInCores.
+	MetricCPU MetricKind = "cpu"
+	// MetricMemory tracks MemoryWorkingSetInBytes.
+	MetricMemory MetricKind = "memory"
+	// MetricNetwork tracks RxBytesPerSecond/TxBytesPerSecond.
+	MetricNetwork MetricKind = "network"
+	// MetricFilesystem tracks FsUsedBytes/FsInodesUsed/LogsUsedBytes.
+	MetricFilesystem MetricKind = "filesystem"
+	// MetricEphemeralStorage tracks EphemeralStorageUsedBytes.
+	MetricEphemeralStorage MetricKind = "ephemeral-storage"
+)
+
+// defaultMetrics preserves the gatherer's original CPU+memory-only output
+// shape when ResourceGathererOptions.Metrics is left unset.
+var defaultMetrics = []MetricKind{MetricCPU, MetricMemory}
+
+func hasMetric(metrics []MetricKind, kind MetricKind) bool {
+	for _, m := range metrics {
+		if m == kind {
+			return true
+		}
+	}
+	return false
+}
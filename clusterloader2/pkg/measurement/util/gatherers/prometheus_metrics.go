@@ -0,0 +1,137 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gatherers
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog"
+	"k8s.io/perf-tests/clusterloader2/pkg/measurement/util"
+)
+
+// liveQuantiles are the percentiles kept up to date on the Prometheus
+// endpoint while a run is still in progress; the full set requested by the
+// caller is still computed once at the end, in StopAndSummarize.
+var liveQuantiles = []int{50, 90, 99}
+
+// startMetricsServer registers the gauges, stands up the /metrics endpoint
+// on options.PrometheusListenAddr and starts the goroutine that keeps the
+// gauges in sync with the in-flight worker data, following the kube-state-
+// metrics exposition model so a run can be scraped by Prometheus/Grafana
+// while it is still running.
+func (g *ContainerResourceGatherer) startMetricsServer() {
+	g.metricsReg = prometheus.NewRegistry()
+	g.cpuGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "clusterloader_container_cpu_cores",
+		Help: "Latest observed CPU usage of a container, in cores.",
+	}, []string{"node", "pod", "container"})
+	g.memGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "clusterloader_container_memory_working_set_bytes",
+		Help: "Latest observed memory working set of a container, in bytes.",
+	}, []string{"node", "pod", "container"})
+	g.quantileGauge = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "clusterloader_container_cpu_quantile",
+		Help: "CPU usage quantiles computed so far over the run, in cores.",
+	}, []string{"container", "quantile"})
+	g.metricsReg.MustRegister(g.cpuGauge, g.memGauge, g.quantileGauge)
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(g.metricsReg, promhttp.HandlerOpts{}))
+	g.metricsServer = &http.Server{Addr: g.options.PrometheusListenAddr, Handler: mux}
+	go func() {
+		if err := g.metricsServer.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			klog.Errorf("Resource gatherer metrics server error: %v", err)
+		}
+	}()
+
+	go g.refreshMetricsLoop()
+}
+
+// refreshMetricsLoop polls the workers' dataSeries at the same cadence as
+// probes are taken and republishes the latest sample and incremental
+// quantiles, until the gatherer is stopped.
+func (g *ContainerResourceGatherer) refreshMetricsLoop() {
+	period := g.options.ResourceDataGatheringPeriod
+	if period <= 0 {
+		period = time.Minute
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-g.stopCh:
+			return
+		case <-ticker.C:
+			g.refreshMetricsOnce()
+		}
+	}
+}
+
+func (g *ContainerResourceGatherer) refreshMetricsOnce() {
+	g.workersLock.Lock()
+	workers := append([]*resourceGatherWorker{}, g.workers...)
+	g.workersLock.Unlock()
+
+	for _, w := range workers {
+		latest, ok := w.dataSeries.last()
+		if !ok {
+			continue
+		}
+		for name, usage := range latest {
+			pod := w.dataSeries.podFor(name)
+			g.cpuGauge.WithLabelValues(w.nodeName, pod, name).Set(usage.CPUUsageInCores)
+			g.memGauge.WithLabelValues(w.nodeName, pod, name).Set(float64(usage.MemoryWorkingSetInBytes))
+		}
+
+		stats := util.ComputePercentiles(w.dataSeries.snapshot(), liveQuantiles)
+		for _, perc := range liveQuantiles {
+			for name, usage := range stats[perc] {
+				g.quantileGauge.WithLabelValues(name, quantileLabel(perc)).Set(usage.CPUUsageInCores)
+			}
+		}
+	}
+}
+
+func quantileLabel(percentile int) string {
+	switch percentile {
+	case 50:
+		return "0.5"
+	case 90:
+		return "0.9"
+	case 99:
+		return "0.99"
+	default:
+		return strconv.FormatFloat(float64(percentile)/100, 'f', -1, 64)
+	}
+}
+
+// stopMetricsServer shuts down the /metrics HTTP server, if one was started.
+func (g *ContainerResourceGatherer) stopMetricsServer() {
+	if g.metricsServer == nil {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := g.metricsServer.Shutdown(ctx); err != nil {
+		klog.Errorf("Error shutting down resource gatherer metrics server: %v", err)
+	}
+}
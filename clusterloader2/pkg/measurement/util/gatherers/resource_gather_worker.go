@@ -0,0 +1,396 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gatherers
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"k8s.io/apimachinery/pkg/util/sets"
+	clientset "k8s.io/client-go/kubernetes"
+	"k8s.io/klog"
+	"k8s.io/perf-tests/clusterloader2/pkg/measurement/util"
+)
+
+// resourceGatherWorker periodically probes a single node's kubelet
+// /stats/summary endpoint and appends the result to dataSeries, until
+// stopCh is closed.
+type resourceGatherWorker struct {
+	c        clientset.Interface
+	nodeName string
+	metrics  []MetricKind
+
+	// containerIDs is refreshed by ensureWorkerForNode as the informer-driven
+	// discovery path learns about more of a node's containers (a pod's
+	// ContainerStatuses are normally still empty the moment it's first
+	// observed), so it's guarded by containerIDsMu rather than only being set
+	// once at construction time.
+	containerIDsMu sync.Mutex
+	containerIDs   []string
+
+	wg     *sync.WaitGroup
+	stopCh chan struct{}
+	doneCh chan struct{}
+
+	// finished is set to 1 (via atomic) once gather's loop has returned, so
+	// callers can check completion without blocking on doneCh or wg.
+	finished int32
+
+	dataSeries *dataSeriesStore
+
+	inKubemark                  bool
+	resourceDataGatheringPeriod time.Duration
+	probeDuration               time.Duration
+	printVerboseLogs            bool
+	host                        string
+	provider                    string
+
+	// lastNetwork is only ever touched by this worker's own gather goroutine,
+	// so it needs no locking.
+	lastNetwork map[string]networkSample
+}
+
+// isFinished reports whether gather's loop has returned for this worker.
+func (w *resourceGatherWorker) isFinished() bool {
+	return atomic.LoadInt32(&w.finished) == 1
+}
+
+// setContainerIDs replaces the set of containers this worker restricts its
+// probes to. Safe to call concurrently with probeOnce.
+func (w *resourceGatherWorker) setContainerIDs(containerIDs []string) {
+	w.containerIDsMu.Lock()
+	defer w.containerIDsMu.Unlock()
+	w.containerIDs = containerIDs
+}
+
+// getContainerIDs returns the container IDs set at construction time or by
+// the most recent setContainerIDs call.
+func (w *resourceGatherWorker) getContainerIDs() []string {
+	w.containerIDsMu.Lock()
+	defer w.containerIDsMu.Unlock()
+	return w.containerIDs
+}
+
+// gather is the worker's main loop: it waits out initialDelay (the
+// stagger applied so workers don't all probe in lockstep), then probes
+// once per resourceDataGatheringPeriod until stopCh is closed.
+func (w *resourceGatherWorker) gather(initialDelay time.Duration) {
+	defer w.wg.Done()
+	defer close(w.doneCh)
+	defer atomic.StoreInt32(&w.finished, 1)
+
+	select {
+	case <-time.After(initialDelay):
+	case <-w.stopCh:
+		return
+	}
+
+	period := w.resourceDataGatheringPeriod
+	if period <= 0 {
+		period = time.Minute
+	}
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+	for {
+		w.probeOnce()
+		select {
+		case <-w.stopCh:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// waitFinished blocks until this worker's gather loop has returned.
+func (w *resourceGatherWorker) waitFinished() {
+	<-w.doneCh
+}
+
+// probeOnce fetches the node's kubelet summary, extracts a sample per
+// tracked container and appends it to dataSeries. Probe failures are
+// logged (when PrintVerboseLogs is set) and otherwise skipped -- a single
+// missed probe shouldn't abort the run.
+func (w *resourceGatherWorker) probeOnce() {
+	summary, err := w.fetchSummary()
+	if err != nil {
+		if w.printVerboseLogs {
+			klog.Warningf("resourceGatherWorker(%s): %v", w.nodeName, err)
+		}
+		return
+	}
+	usage, podByContainer := w.extractUsage(summary)
+	w.dataSeries.append(usage, podByContainer)
+}
+
+func (w *resourceGatherWorker) fetchSummary() (*kubeletSummary, error) {
+	if w.inKubemark {
+		return fetchKubemarkSummary(w.host, w.probeDuration)
+	}
+	return fetchNodeSummary(w.c, w.nodeName, w.probeDuration)
+}
+
+// extractUsage converts a kubelet summary into a ResourceUsagePerContainer
+// sample, restricted to w.containerIDs when non-empty, plus the
+// container->pod mapping Prometheus metrics need for their "pod" label.
+func (w *resourceGatherWorker) extractUsage(summary *kubeletSummary) (util.ResourceUsagePerContainer, map[string]string) {
+	containerIDs := w.getContainerIDs()
+	wanted := sets.NewString(containerIDs...)
+	now := time.Now()
+	usage := make(util.ResourceUsagePerContainer)
+	podByContainer := make(map[string]string)
+
+	for _, pod := range summary.Pods {
+		rxRate, txRate := w.networkRate(pod.PodRef.Name, pod.Network.rxBytesTotal(), pod.Network.txBytesTotal(), now)
+		var ephemeralUsed int64
+		if pod.EphemeralStorage != nil && pod.EphemeralStorage.UsedBytes != nil {
+			ephemeralUsed = int64(*pod.EphemeralStorage.UsedBytes)
+		}
+
+		for _, c := range pod.Containers {
+			if len(containerIDs) > 0 && !wanted.Has(c.Name) {
+				continue
+			}
+			ru := util.ResourceUsage{
+				RxBytesPerSecond:          rxRate,
+				TxBytesPerSecond:          txRate,
+				EphemeralStorageUsedBytes: ephemeralUsed,
+			}
+			if c.CPU != nil && c.CPU.UsageNanoCores != nil {
+				ru.CPUUsageInCores = float64(*c.CPU.UsageNanoCores) / 1e9
+			}
+			if c.Memory != nil && c.Memory.WorkingSetBytes != nil {
+				ru.MemoryWorkingSetInBytes = int64(*c.Memory.WorkingSetBytes)
+			}
+			if c.Rootfs != nil && c.Rootfs.UsedBytes != nil {
+				ru.FsUsedBytes = int64(*c.Rootfs.UsedBytes)
+			}
+			if c.Rootfs != nil && c.Rootfs.InodesUsed != nil {
+				ru.FsInodesUsed = int64(*c.Rootfs.InodesUsed)
+			}
+			if c.Logs != nil && c.Logs.UsedBytes != nil {
+				ru.LogsUsedBytes = int64(*c.Logs.UsedBytes)
+			}
+			usage[c.Name] = ru
+			podByContainer[c.Name] = pod.PodRef.Name
+		}
+	}
+	return usage, podByContainer
+}
+
+// networkSample is the last observed cumulative network counters for a pod,
+// used to turn the kubelet's monotonic byte counters into a per-second rate.
+type networkSample struct {
+	rxBytes uint64
+	txBytes uint64
+	at      time.Time
+}
+
+// networkRate returns the rx/tx bytes-per-second rate for podName since the
+// last probe, or (0, 0) on the first observation or a counter reset (e.g.
+// the pod restarted).
+func (w *resourceGatherWorker) networkRate(podName string, rxTotal, txTotal uint64, now time.Time) (float64, float64) {
+	if w.lastNetwork == nil {
+		w.lastNetwork = make(map[string]networkSample)
+	}
+	prev, ok := w.lastNetwork[podName]
+	w.lastNetwork[podName] = networkSample{rxBytes: rxTotal, txBytes: txTotal, at: now}
+	if !ok || rxTotal < prev.rxBytes || txTotal < prev.txBytes {
+		return 0, 0
+	}
+	elapsed := now.Sub(prev.at).Seconds()
+	if elapsed <= 0 {
+		return 0, 0
+	}
+	return float64(rxTotal-prev.rxBytes) / elapsed, float64(txTotal-prev.txBytes) / elapsed
+}
+
+// kubeletSummary is the subset of the kubelet's /stats/summary response this
+// gatherer reads.
+type kubeletSummary struct {
+	Pods []summaryPodStats `json:"pods"`
+}
+
+type summaryPodStats struct {
+	PodRef struct {
+		Name string `json:"name"`
+	} `json:"podRef"`
+	Containers       []summaryContainerStats `json:"containers"`
+	Network          *summaryNetworkStats    `json:"network"`
+	EphemeralStorage *summaryFsStats         `json:"ephemeral-storage"`
+}
+
+type summaryContainerStats struct {
+	Name   string              `json:"name"`
+	CPU    *summaryCPUStats    `json:"cpu"`
+	Memory *summaryMemoryStats `json:"memory"`
+	Rootfs *summaryFsStats     `json:"rootfs"`
+	Logs   *summaryFsStats     `json:"logs"`
+}
+
+type summaryCPUStats struct {
+	UsageNanoCores *uint64 `json:"usageNanoCores"`
+}
+
+type summaryMemoryStats struct {
+	WorkingSetBytes *uint64 `json:"workingSetBytes"`
+}
+
+type summaryFsStats struct {
+	UsedBytes  *uint64 `json:"usedBytes"`
+	InodesUsed *uint64 `json:"inodesUsed"`
+}
+
+type summaryNetworkStats struct {
+	RxBytes    *uint64               `json:"rxBytes"`
+	TxBytes    *uint64               `json:"txBytes"`
+	Interfaces []summaryNetworkStats `json:"interfaces"`
+}
+
+func (n *summaryNetworkStats) rxBytesTotal() uint64 {
+	if n == nil {
+		return 0
+	}
+	if n.RxBytes != nil {
+		return *n.RxBytes
+	}
+	var total uint64
+	for _, iface := range n.Interfaces {
+		if iface.RxBytes != nil {
+			total += *iface.RxBytes
+		}
+	}
+	return total
+}
+
+func (n *summaryNetworkStats) txBytesTotal() uint64 {
+	if n == nil {
+		return 0
+	}
+	if n.TxBytes != nil {
+		return *n.TxBytes
+	}
+	var total uint64
+	for _, iface := range n.Interfaces {
+		if iface.TxBytes != nil {
+			total += *iface.TxBytes
+		}
+	}
+	return total
+}
+
+// fetchNodeSummary pulls /stats/summary from nodeName's kubelet through the
+// API server's node proxy subresource.
+func fetchNodeSummary(c clientset.Interface, nodeName string, timeout time.Duration) (*kubeletSummary, error) {
+	req := c.CoreV1().RESTClient().Get().
+		Resource("nodes").
+		Name(nodeName).
+		SubResource("proxy").
+		Suffix("stats/summary")
+	if timeout > 0 {
+		req = req.Timeout(timeout)
+	}
+	raw, err := req.Do().Raw()
+	if err != nil {
+		return nil, fmt.Errorf("fetching /stats/summary from node %q: %v", nodeName, err)
+	}
+	return parseKubeletSummary(raw)
+}
+
+// fetchKubemarkSummary pulls /stats/summary over plain HTTP directly from
+// host, rather than going through the API server's node proxy.
+func fetchKubemarkSummary(host string, timeout time.Duration) (*kubeletSummary, error) {
+	if timeout <= 0 {
+		timeout = 30 * time.Second
+	}
+	client := &http.Client{Timeout: timeout}
+	resp, err := client.Get(fmt.Sprintf("http://%s/stats/summary", host))
+	if err != nil {
+		return nil, fmt.Errorf("fetching /stats/summary from kubemark host %q: %v", host, err)
+	}
+	defer resp.Body.Close()
+	raw, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("reading /stats/summary response from kubemark host %q: %v", host, err)
+	}
+	return parseKubeletSummary(raw)
+}
+
+func parseKubeletSummary(raw []byte) (*kubeletSummary, error) {
+	summary := &kubeletSummary{}
+	if err := json.Unmarshal(raw, summary); err != nil {
+		return nil, fmt.Errorf("parsing /stats/summary response: %v", err)
+	}
+	return summary, nil
+}
+
+// dataSeriesStore holds a worker's accumulated samples behind a mutex, so it
+// can be safely read (by StopAndSummarize, WriteSupportBundle and the live
+// Prometheus endpoint) while the worker's own goroutine is still appending
+// to it.
+type dataSeriesStore struct {
+	mu             sync.Mutex
+	series         []util.ResourceUsagePerContainer
+	podByContainer map[string]string
+}
+
+func newDataSeriesStore() *dataSeriesStore {
+	return &dataSeriesStore{podByContainer: make(map[string]string)}
+}
+
+// append records sample, merging any newly observed container->pod names
+// into the store's running podByContainer map.
+func (s *dataSeriesStore) append(sample util.ResourceUsagePerContainer, podByContainer map[string]string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.series = append(s.series, sample)
+	for name, pod := range podByContainer {
+		s.podByContainer[name] = pod
+	}
+}
+
+// snapshot returns a copy of the samples recorded so far, safe to range
+// over without holding the store's lock.
+func (s *dataSeriesStore) snapshot() []util.ResourceUsagePerContainer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make([]util.ResourceUsagePerContainer, len(s.series))
+	copy(out, s.series)
+	return out
+}
+
+// last returns the most recent sample, or ok=false if none has been
+// recorded yet.
+func (s *dataSeriesStore) last() (util.ResourceUsagePerContainer, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.series) == 0 {
+		return nil, false
+	}
+	return s.series[len(s.series)-1], true
+}
+
+// podFor returns the last observed pod name for container, or "" if unknown.
+func (s *dataSeriesStore) podFor(container string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.podByContainer[container]
+}
@@ -0,0 +1,200 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gatherers
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"k8s.io/klog"
+)
+
+// BundleProgress reports WriteSupportBundle's progress as it writes the
+// archive: one update per node, after all of that node's CSV files are
+// added (File is the node name), and one for manifest.json. Total counts
+// those updates, not the files in the archive.
+type BundleProgress struct {
+	Done  int
+	Total int
+	File  string
+}
+
+// supportBundleManifest is the content of manifest.json in the archive
+// written by WriteSupportBundle.
+type supportBundleManifest struct {
+	Options      manifestOptions       `json:"options"`
+	Nodes        []string              `json:"nodes"`
+	ContainerIDs []string              `json:"containerIds"`
+	Summary      *ResourceUsageSummary `json:"summary,omitempty"`
+}
+
+// manifestOptions mirrors ResourceGathererOptions, dropping the BundleProgress
+// channel which can't be marshalled to JSON.
+type manifestOptions struct {
+	InKubemark                  bool          `json:"inKubemark"`
+	Nodes                       NodesSet      `json:"nodes"`
+	ResourceDataGatheringPeriod time.Duration `json:"resourceDataGatheringPeriod"`
+	ProbeDuration               time.Duration `json:"probeDuration"`
+	PrintVerboseLogs            bool          `json:"printVerboseLogs"`
+	UseInformers                bool          `json:"useInformers"`
+	PrometheusListenAddr        string        `json:"prometheusListenAddr,omitempty"`
+	StreamingQuantile           bool          `json:"streamingQuantile"`
+	Metrics                     []MetricKind  `json:"metrics,omitempty"`
+}
+
+// WriteSupportBundle serializes every worker's raw dataSeries into a zip
+// archive at path, one {nodeName}/{containerName}.csv file per container
+// plus a manifest.json recording the options, observed nodes and the
+// computed summary -- modelled on the support-bundle/must-gather pattern, so
+// a run can be re-percentiled, plotted or correlated with other events after
+// the fact instead of only consulting the percentiles StopAndSummarize kept.
+func (g *ContainerResourceGatherer) WriteSupportBundle(path string) error {
+	g.workersLock.Lock()
+	allWorkers := append(append([]*resourceGatherWorker{}, g.workers...), g.departedWorkers...)
+	g.workersLock.Unlock()
+
+	summary, err := summarize(allWorkers, []int{50, 90, 99}, g.options.StreamingQuantile, g.options.Metrics)
+	if err != nil {
+		klog.Warningf("WriteSupportBundle: failed to compute summary: %v", err)
+		summary = nil
+	}
+
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("creating support bundle %q: %v", path, err)
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	defer zw.Close()
+
+	total := len(allWorkers) + 1
+	done := 0
+	reportProgress := func(name string) {
+		done++
+		if g.options.BundleProgress != nil {
+			g.options.BundleProgress <- BundleProgress{Done: done, Total: total, File: name}
+		}
+	}
+
+	nodes := make([]string, 0, len(allWorkers))
+	for _, w := range allWorkers {
+		nodes = append(nodes, w.nodeName)
+		if err := writeWorkerCSVs(zw, w, g.options.Metrics); err != nil {
+			return err
+		}
+		reportProgress(w.nodeName)
+	}
+
+	manifest := supportBundleManifest{
+		Options: manifestOptions{
+			InKubemark:                  g.options.InKubemark,
+			Nodes:                       g.options.Nodes,
+			ResourceDataGatheringPeriod: g.options.ResourceDataGatheringPeriod,
+			ProbeDuration:               g.options.ProbeDuration,
+			PrintVerboseLogs:            g.options.PrintVerboseLogs,
+			UseInformers:                g.options.UseInformers,
+			PrometheusListenAddr:        g.options.PrometheusListenAddr,
+			StreamingQuantile:           g.options.StreamingQuantile,
+			Metrics:                     g.options.Metrics,
+		},
+		Nodes:        nodes,
+		ContainerIDs: append([]string{}, g.containerIDs...),
+		Summary:      summary,
+	}
+	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshalling support bundle manifest: %v", err)
+	}
+	mw, err := zw.Create("manifest.json")
+	if err != nil {
+		return fmt.Errorf("creating manifest.json in support bundle: %v", err)
+	}
+	if _, err := mw.Write(manifestBytes); err != nil {
+		return fmt.Errorf("writing manifest.json in support bundle: %v", err)
+	}
+	reportProgress("manifest.json")
+	return nil
+}
+
+// writeWorkerCSVs adds one {containerName}.csv file per container tracked by
+// w, under a w.nodeName directory in zw. The timestamp column is the
+// sample's index in w's dataSeries times ResourceDataGatheringPeriod, in
+// seconds. Probe times are not recorded, so the column does not account for
+// the worker's start delay or for probes that failed and recorded no
+// sample. Columns beyond cpu_cores/memory_working_set_bytes are
+// only included for the metrics the run was configured to collect -- a
+// bundle taken with e.g. Metrics: []MetricKind{MetricNetwork} should still
+// export the data it was configured to collect.
+func writeWorkerCSVs(zw *zip.Writer, w *resourceGatherWorker, metrics []MetricKind) error {
+	header := "timestamp,cpu_cores,memory_working_set_bytes"
+	if hasMetric(metrics, MetricNetwork) {
+		header += ",rx_bytes_per_second,tx_bytes_per_second"
+	}
+	if hasMetric(metrics, MetricFilesystem) {
+		header += ",fs_used_bytes,fs_inodes_used,logs_used_bytes"
+	}
+	if hasMetric(metrics, MetricEphemeralStorage) {
+		header += ",ephemeral_storage_used_bytes"
+	}
+	header += "\n"
+
+	byContainer := make(map[string]*bytes.Buffer)
+	for i, snapshot := range w.dataSeries.snapshot() {
+		ts := (time.Duration(i) * w.resourceDataGatheringPeriod).Seconds()
+		for name, usage := range snapshot {
+			buf, ok := byContainer[name]
+			if !ok {
+				buf = &bytes.Buffer{}
+				buf.WriteString(header)
+				byContainer[name] = buf
+			}
+			fmt.Fprintf(buf, "%f,%f,%d", ts, usage.CPUUsageInCores, usage.MemoryWorkingSetInBytes)
+			if hasMetric(metrics, MetricNetwork) {
+				fmt.Fprintf(buf, ",%f,%f", usage.RxBytesPerSecond, usage.TxBytesPerSecond)
+			}
+			if hasMetric(metrics, MetricFilesystem) {
+				fmt.Fprintf(buf, ",%d,%d,%d", usage.FsUsedBytes, usage.FsInodesUsed, usage.LogsUsedBytes)
+			}
+			if hasMetric(metrics, MetricEphemeralStorage) {
+				fmt.Fprintf(buf, ",%d", usage.EphemeralStorageUsedBytes)
+			}
+			buf.WriteString("\n")
+		}
+	}
+
+	names := make([]string, 0, len(byContainer))
+	for name := range byContainer {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		entryPath := fmt.Sprintf("%s/%s.csv", w.nodeName, name)
+		fw, err := zw.Create(entryPath)
+		if err != nil {
+			return fmt.Errorf("creating %s in support bundle: %v", entryPath, err)
+		}
+		if _, err := fw.Write(byContainer[name].Bytes()); err != nil {
+			return fmt.Errorf("writing %s in support bundle: %v", entryPath, err)
+		}
+	}
+	return nil
+}
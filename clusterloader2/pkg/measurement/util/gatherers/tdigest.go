@@ -0,0 +1,209 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gatherers
+
+import (
+	"math"
+	"sort"
+)
+
+// defaultTDigestCompression is the default centroid-count bound (delta) used
+// when StreamingQuantile is enabled.
+const defaultTDigestCompression = 100
+
+// centroid is a single (mean, weight) point a TDigest keeps instead of every
+// raw sample.
+type centroid struct {
+	mean   float64
+	weight float64
+}
+
+// TDigest is a streaming quantile sketch (Dunning & Ertl) that bounds memory
+// on long runs: instead of retaining every sample, it keeps a sorted list of
+// centroids whose count is bounded by roughly the compression parameter.
+// Insertion merges a new value into its nearest centroid whenever the
+// scale function k(q) = compression*asin(2q-1)/pi allows the centroid's
+// weight to grow without exceeding its quantile-dependent cap; otherwise a
+// new centroid is created.
+type TDigest struct {
+	compression float64
+	centroids   []centroid
+	count       float64
+}
+
+// NewTDigest creates a TDigest bounding its centroid count by compression. A
+// compression <= 0 falls back to defaultTDigestCompression.
+func NewTDigest(compression float64) *TDigest {
+	if compression <= 0 {
+		compression = defaultTDigestCompression
+	}
+	return &TDigest{compression: compression}
+}
+
+// Add inserts a weighted sample into the digest.
+func (t *TDigest) Add(value, weight float64) {
+	if weight <= 0 {
+		return
+	}
+	if len(t.centroids) == 0 {
+		t.centroids = append(t.centroids, centroid{mean: value, weight: weight})
+		t.count = weight
+		return
+	}
+
+	i := sort.Search(len(t.centroids), func(i int) bool { return t.centroids[i].mean >= value })
+	best, bestDist := -1, math.MaxFloat64
+	for _, c := range []int{i - 1, i} {
+		if c < 0 || c >= len(t.centroids) {
+			continue
+		}
+		if d := math.Abs(t.centroids[c].mean - value); d < bestDist {
+			best, bestDist = c, d
+		}
+	}
+
+	if best >= 0 {
+		newWeight := t.centroids[best].weight + weight
+		if newWeight <= t.maxWeightAt(t.cumulativeWeightBefore(best)) {
+			c := &t.centroids[best]
+			c.mean += (value - c.mean) * weight / newWeight
+			c.weight = newWeight
+			t.count += weight
+			return
+		}
+	}
+
+	t.centroids = append(t.centroids, centroid{})
+	copy(t.centroids[i+1:], t.centroids[i:])
+	t.centroids[i] = centroid{mean: value, weight: weight}
+	t.count += weight
+
+	if len(t.centroids) > int(10*t.compression) {
+		t.Compress()
+	}
+}
+
+// Merge folds other's centroids into t: a concatenation of the two centroid
+// lists followed by a re-compress pass.
+func (t *TDigest) Merge(other *TDigest) {
+	if other == nil || len(other.centroids) == 0 {
+		return
+	}
+	t.centroids = append(t.centroids, other.centroids...)
+	t.count += other.count
+	t.Compress()
+}
+
+// Compress re-sorts and greedily merges adjacent centroids back down to the
+// compression bound.
+func (t *TDigest) Compress() {
+	if len(t.centroids) < 2 {
+		return
+	}
+	sort.Slice(t.centroids, func(i, j int) bool { return t.centroids[i].mean < t.centroids[j].mean })
+
+	merged := make([]centroid, 0, len(t.centroids))
+	merged = append(merged, t.centroids[0])
+	var cumBefore float64
+	for _, c := range t.centroids[1:] {
+		last := &merged[len(merged)-1]
+		newWeight := last.weight + c.weight
+		if newWeight <= t.maxWeightAt(cumBefore) {
+			last.mean += (c.mean - last.mean) * c.weight / newWeight
+			last.weight = newWeight
+			continue
+		}
+		cumBefore += last.weight
+		merged = append(merged, c)
+	}
+	t.centroids = merged
+}
+
+// Quantile interpolates the value at quantile q (0..1) by linearly
+// interpolating between the centers of the two centroids (cumulative weight
+// up to a centroid's own mean, i.e. cumBefore + weight/2) that target falls
+// between, per the standard t-digest quantile query. q before the first
+// centroid's center or after the last one's clamps to that centroid's mean.
+func (t *TDigest) Quantile(q float64) float64 {
+	if len(t.centroids) == 0 {
+		return 0
+	}
+	if q <= 0 {
+		return t.centroids[0].mean
+	}
+	if q >= 1 {
+		return t.centroids[len(t.centroids)-1].mean
+	}
+
+	target := q * t.count
+	var cumBefore float64
+	prevWeightCenter := 0.0
+	prevMean := t.centroids[0].mean
+	for i, c := range t.centroids {
+		weightCenter := cumBefore + c.weight/2
+		if target < weightCenter {
+			if i == 0 {
+				return c.mean
+			}
+			frac := (target - prevWeightCenter) / (weightCenter - prevWeightCenter)
+			return prevMean + frac*(c.mean-prevMean)
+		}
+		cumBefore += c.weight
+		prevWeightCenter = weightCenter
+		prevMean = c.mean
+	}
+	return t.centroids[len(t.centroids)-1].mean
+}
+
+// cumulativeWeightBefore sums the weight of every centroid strictly before
+// idx.
+func (t *TDigest) cumulativeWeightBefore(idx int) float64 {
+	var cum float64
+	for i := 0; i < idx; i++ {
+		cum += t.centroids[i].weight
+	}
+	return cum
+}
+
+// maxWeightAt returns the most weight a centroid starting at cumulative
+// weight cumBefore may hold before it must split into another centroid, per
+// the t-digest scale function.
+func (t *TDigest) maxWeightAt(cumBefore float64) float64 {
+	if t.count == 0 {
+		return 0
+	}
+	q := cumBefore / t.count
+	qHigh := t.invScale(t.scale(q) + 1)
+	if qHigh < q {
+		qHigh = q
+	}
+	return (qHigh - q) * t.count
+}
+
+func (t *TDigest) scale(q float64) float64 {
+	if q < 0 {
+		q = 0
+	}
+	if q > 1 {
+		q = 1
+	}
+	return t.compression * math.Asin(2*q-1) / math.Pi
+}
+
+func (t *TDigest) invScale(k float64) float64 {
+	return (math.Sin(k*math.Pi/t.compression) + 1) / 2
+}
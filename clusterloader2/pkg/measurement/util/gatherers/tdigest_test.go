@@ -0,0 +1,109 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package gatherers
+
+import (
+	"math"
+	"math/rand"
+	"sort"
+	"testing"
+)
+
+func exactQuantile(sorted []float64, q float64) float64 {
+	idx := int(q * float64(len(sorted)))
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+// TestTDigestQuantileUniform feeds a uniformly distributed sample set into a
+// compressed TDigest and checks every queried quantile against the exact
+// value, within the tolerance a lossy sketch is expected to introduce. This
+// is the "critical invariant" regression test for the Quantile interpolation
+// bug that shipped in an earlier version of this function.
+func TestTDigestQuantileUniform(t *testing.T) {
+	rng := rand.New(rand.NewSource(42))
+	const n = 100000
+	samples := make([]float64, n)
+	for i := range samples {
+		samples[i] = rng.Float64() * 100000
+	}
+	sorted := append([]float64{}, samples...)
+	sort.Float64s(sorted)
+
+	td := NewTDigest(100)
+	for _, s := range samples {
+		td.Add(s, 1)
+	}
+
+	for _, q := range []float64{0.01, 0.1, 0.5, 0.9, 0.99} {
+		got := td.Quantile(q)
+		want := exactQuantile(sorted, q)
+		if diff := math.Abs(got - want); diff > 0.02*want {
+			t.Errorf("Quantile(%v) = %v, want ~%v (diff %v exceeds 2%% tolerance)", q, got, want, diff)
+		}
+	}
+}
+
+// TestTDigestQuantileTwoCentroids exercises the minimal case that exposed
+// the interpolation bug directly: a digest with exactly two equally-weighted
+// centroids must not report a quantile outside [mean0, mean1].
+func TestTDigestQuantileTwoCentroids(t *testing.T) {
+	td := NewTDigest(100)
+	td.Add(0, 10)
+	td.Add(100, 10)
+
+	for _, q := range []float64{0.01, 0.25, 0.5, 0.75, 0.99} {
+		got := td.Quantile(q)
+		if got < 0 || got > 100 {
+			t.Errorf("Quantile(%v) = %v, want a value in [0, 100]", q, got)
+		}
+	}
+
+	if got := td.Quantile(0.5); math.Abs(got-50) > 25 {
+		t.Errorf("Quantile(0.5) = %v, want roughly 50 for two symmetric equally-weighted centroids", got)
+	}
+}
+
+// TestTDigestQuantileEdges checks the q<=0/q>=1 clamping and the
+// single-centroid/empty-digest special cases.
+func TestTDigestQuantileEdges(t *testing.T) {
+	empty := NewTDigest(100)
+	if got := empty.Quantile(0.5); got != 0 {
+		t.Errorf("empty digest Quantile(0.5) = %v, want 0", got)
+	}
+
+	single := NewTDigest(100)
+	single.Add(42, 1)
+	for _, q := range []float64{0, 0.5, 1} {
+		if got := single.Quantile(q); got != 42 {
+			t.Errorf("single-centroid Quantile(%v) = %v, want 42", q, got)
+		}
+	}
+
+	td := NewTDigest(100)
+	td.Add(1, 1)
+	td.Add(2, 1)
+	td.Add(3, 1)
+	if got := td.Quantile(0); got != 1 {
+		t.Errorf("Quantile(0) = %v, want the minimum centroid mean 1", got)
+	}
+	if got := td.Quantile(1); got != 3 {
+		t.Errorf("Quantile(1) = %v, want the maximum centroid mean 3", got)
+	}
+}
@@ -0,0 +1,144 @@
+/*
+Copyright 2018 The Kubernetes Authors.
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package util
+
+import "sort"
+
+// ResourceUsage is a single container's resource sample, read off the
+// kubelet's /stats/summary response. Every field is populated on each
+// sample; the gatherer's Metrics option only decides which fields beyond
+// CPU and memory are reported in its summary and support bundle.
+type ResourceUsage struct {
+	CPUUsageInCores         float64
+	MemoryWorkingSetInBytes int64
+
+	RxBytesPerSecond          float64
+	TxBytesPerSecond          float64
+	FsUsedBytes               int64
+	FsInodesUsed              int64
+	LogsUsedBytes             int64
+	EphemeralStorageUsedBytes int64
+}
+
+// ResourceUsagePerContainer maps a container name to its resource sample.
+type ResourceUsagePerContainer map[string]ResourceUsage
+
+// SingleContainerSummary is one container's percentile summary.
+type SingleContainerSummary struct {
+	Name string
+	Cpu  float64
+	Mem  int64
+
+	RxBytesPerSecond          float64
+	TxBytesPerSecond          float64
+	FsUsedBytes               int64
+	FsInodesUsed              int64
+	LogsUsedBytes             int64
+	EphemeralStorageUsedBytes int64
+}
+
+// ComputePercentiles computes, for every container present in timeSeries and
+// every requested percentile, an independent percentile per ResourceUsage
+// field.
+func ComputePercentiles(timeSeries []ResourceUsagePerContainer, percentilesToCompute []int) map[int]ResourceUsagePerContainer {
+	result := make(map[int]ResourceUsagePerContainer)
+	if len(timeSeries) == 0 {
+		return result
+	}
+
+	samplesByContainer := make(map[string][]ResourceUsage)
+	for _, snapshot := range timeSeries {
+		for name, usage := range snapshot {
+			samplesByContainer[name] = append(samplesByContainer[name], usage)
+		}
+	}
+
+	for name, samples := range samplesByContainer {
+		cpu := fieldValues(samples, func(u ResourceUsage) float64 { return u.CPUUsageInCores })
+		mem := fieldValues(samples, func(u ResourceUsage) float64 { return float64(u.MemoryWorkingSetInBytes) })
+		rx := fieldValues(samples, func(u ResourceUsage) float64 { return u.RxBytesPerSecond })
+		tx := fieldValues(samples, func(u ResourceUsage) float64 { return u.TxBytesPerSecond })
+		fsUsed := fieldValues(samples, func(u ResourceUsage) float64 { return float64(u.FsUsedBytes) })
+		fsInodes := fieldValues(samples, func(u ResourceUsage) float64 { return float64(u.FsInodesUsed) })
+		logsUsed := fieldValues(samples, func(u ResourceUsage) float64 { return float64(u.LogsUsedBytes) })
+		ephemeral := fieldValues(samples, func(u ResourceUsage) float64 { return float64(u.EphemeralStorageUsedBytes) })
+
+		for _, perc := range percentilesToCompute {
+			if result[perc] == nil {
+				result[perc] = make(ResourceUsagePerContainer)
+			}
+			result[perc][name] = ResourceUsage{
+				CPUUsageInCores:           percentileOf(cpu, perc),
+				MemoryWorkingSetInBytes:   int64(percentileOf(mem, perc)),
+				RxBytesPerSecond:          percentileOf(rx, perc),
+				TxBytesPerSecond:          percentileOf(tx, perc),
+				FsUsedBytes:               int64(percentileOf(fsUsed, perc)),
+				FsInodesUsed:              int64(percentileOf(fsInodes, perc)),
+				LogsUsedBytes:             int64(percentileOf(logsUsed, perc)),
+				EphemeralStorageUsedBytes: int64(percentileOf(ephemeral, perc)),
+			}
+		}
+	}
+	return result
+}
+
+func fieldValues(samples []ResourceUsage, field func(ResourceUsage) float64) []float64 {
+	values := make([]float64, len(samples))
+	for i, s := range samples {
+		values[i] = field(s)
+	}
+	sort.Float64s(values)
+	return values
+}
+
+func percentileOf(sorted []float64, percentile int) float64 {
+	if len(sorted) == 0 {
+		return 0
+	}
+	idx := int(float64(percentile) / 100 * float64(len(sorted)))
+	if idx >= len(sorted) {
+		idx = len(sorted) - 1
+	}
+	return sorted[idx]
+}
+
+// LeftMergeData merges right into left, preferring left's entries for
+// containers present in both.
+func LeftMergeData(left, right map[int]ResourceUsagePerContainer) map[int]ResourceUsagePerContainer {
+	result := make(map[int]ResourceUsagePerContainer)
+	for perc, usage := range right {
+		merged := make(ResourceUsagePerContainer, len(usage))
+		for name, u := range usage {
+			merged[name] = u
+		}
+		for name, u := range left[perc] {
+			merged[name] = u
+		}
+		result[perc] = merged
+	}
+	for perc, usage := range left {
+		if _, ok := result[perc]; ok {
+			continue
+		}
+		merged := make(ResourceUsagePerContainer, len(usage))
+		for name, u := range usage {
+			merged[name] = u
+		}
+		result[perc] = merged
+	}
+	return result
+}